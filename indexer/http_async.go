@@ -0,0 +1,395 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quay/claircore"
+	je "github.com/quay/claircore/pkg/jsonerr"
+)
+
+const IndexJobAPIPath = "/api/v1/index_job/"
+
+const (
+	// DefaultAsyncQueueSize is how many submitted-but-not-yet-running jobs
+	// h.jobQueue buffers before indexAsync starts rejecting new submissions
+	// with 503, when the caller hasn't configured a different value.
+	DefaultAsyncQueueSize = 64
+	// DefaultAsyncWorkers is how many dispatchJobs goroutines run concurrently
+	// when the caller hasn't configured a different value.
+	DefaultAsyncWorkers = 4
+	// DefaultAsyncJobTimeout bounds how long runJob waits on a single
+	// Service.Index call when the caller hasn't configured a different value.
+	DefaultAsyncJobTimeout = 30 * time.Minute
+)
+
+// JobState is the lifecycle state of an asynchronous index job.
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+// Job is the descriptor returned by an async index submission and served by
+// IndexJobHandler while the job is in flight.
+type Job struct {
+	ID           string   `json:"id"`
+	ManifestHash string   `json:"manifest_hash"`
+	State        JobState `json:"state"`
+	// Progress is a point-in-time hint taken from Service.State(), filled in
+	// by IndexJobHandler rather than stored, since it changes independently
+	// of the job.
+	Progress string                 `json:"progress,omitempty"`
+	Report   *claircore.IndexReport `json:"report,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+
+	// CreatedAt is when the job was queued. It's not part of the public
+	// descriptor; it exists to measure time spent queued versus time spent
+	// indexing.
+	CreatedAt time.Time `json:"-"`
+}
+
+// JobStore tracks the state of in-flight and completed async index jobs. The
+// default, installed by WithAsyncIndex(nil), is an in-process map; embedders
+// that need jobs to survive a restart can back it with the same store used
+// for index reports.
+type JobStore interface {
+	// Create records a new queued job for manifestHash and returns it.
+	Create(ctx context.Context, manifestHash string) (*Job, error)
+	// Get returns the job with the given id, or ok == false if it's unknown.
+	Get(ctx context.Context, id string) (job *Job, ok bool, err error)
+	// Update applies fn to the stored job with the given id.
+	Update(ctx context.Context, id string, fn func(*Job)) error
+}
+
+// memJobStore is the default in-process JobStore.
+type memJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+func newMemJobStore() *memJobStore {
+	return &memJobStore{jobs: make(map[string]*Job)}
+}
+
+func (s *memJobStore) Create(_ context.Context, manifestHash string) (*Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{ID: id, ManifestHash: manifestHash, State: JobQueued, CreatedAt: time.Now()}
+	s.mu.Lock()
+	s.jobs[id] = job
+	s.mu.Unlock()
+	return job, nil
+}
+
+func (s *memJobStore) Get(_ context.Context, id string) (*Job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, false, nil
+	}
+	cp := *job
+	return &cp, true, nil
+}
+
+func (s *memJobStore) Update(_ context.Context, id string, fn func(*Job)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return fmt.Errorf("indexer: no such job %q", id)
+	}
+	fn(job)
+	return nil
+}
+
+func newJobID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// asyncIndexRequest is the POST /api/v1/index?async=1 body: a
+// claircore.Manifest plus an optional callback.
+type asyncIndexRequest struct {
+	claircore.Manifest
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// indexJob is the work handed from indexAsync to the dispatcher goroutine.
+type indexJob struct {
+	job         *Job
+	manifest    *claircore.Manifest
+	callbackURL string
+}
+
+// indexAsync handles POST /api/v1/index?async=1: it queues the manifest for
+// indexing and returns 202 Accepted with a Job descriptor and a Location
+// header pointing at IndexJobHandler, rather than blocking for the full
+// index to complete.
+func (h *HTTP) indexAsync(w http.ResponseWriter, r *http.Request) {
+	var req asyncIndexRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		resp := &je.Response{
+			Code:    "bad-request",
+			Message: fmt.Sprintf("failed to deserialize manifest: %v", err),
+		}
+		je.Error(w, resp, http.StatusBadRequest)
+		return
+	}
+
+	if req.CallbackURL != "" {
+		if !h.allowCallbacks {
+			resp := &je.Response{
+				Code:    "bad-request",
+				Message: "callback_url is not enabled on this server",
+			}
+			je.Error(w, resp, http.StatusBadRequest)
+			return
+		}
+		if err := validateCallbackURL(req.CallbackURL); err != nil {
+			resp := &je.Response{
+				Code:    "bad-request",
+				Message: fmt.Sprintf("invalid callback_url: %v", err),
+			}
+			je.Error(w, resp, http.StatusBadRequest)
+			return
+		}
+	}
+
+	job, err := h.jobStore.Create(r.Context(), req.Manifest.Hash.String())
+	if err != nil {
+		resp := &je.Response{
+			Code:    "internal-server-error",
+			Message: fmt.Sprintf("failed to create index job: %v", err),
+		}
+		je.Error(w, resp, http.StatusInternalServerError)
+		return
+	}
+
+	// Non-blocking: h.jobQueue is sized by WithAsyncQueueSize (or
+	// DefaultAsyncQueueSize) and drained by DefaultAsyncWorkers (or
+	// WithAsyncWorkers) dispatchJobs goroutines. If it's full, reject the
+	// submission instead of blocking the request for as long as the backlog
+	// takes to drain -- exactly the proxy-timeout problem this endpoint
+	// exists to avoid.
+	select {
+	case h.jobQueue <- &indexJob{job: job, manifest: &req.Manifest, callbackURL: req.CallbackURL}:
+	default:
+		h.jobStore.Update(r.Context(), job.ID, func(j *Job) {
+			j.State = JobFailed
+			j.Error = "index job queue is full"
+		})
+		resp := &je.Response{
+			Code:    "unavailable",
+			Message: "index job queue is full; try again later",
+		}
+		je.Error(w, resp, http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("location", IndexJobAPIPath+job.ID)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// IndexJobHandler serves the current state of an async index job submitted
+// via POST /api/v1/index?async=1.
+func (h *HTTP) IndexJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		resp := &je.Response{
+			Code:    "method-not-allowed",
+			Message: "endpoint only allows GET",
+		}
+		je.Error(w, resp, http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, IndexJobAPIPath)
+	if id == "" {
+		resp := &je.Response{
+			Code:    "bad-request",
+			Message: "malformed path. provide a single job id",
+		}
+		je.Error(w, resp, http.StatusBadRequest)
+		return
+	}
+
+	job, ok, err := h.jobStore.Get(r.Context(), id)
+	if err != nil {
+		resp := &je.Response{
+			Code:    "internal-server-error",
+			Message: fmt.Sprintf("failed to load job %s: %v", id, err),
+		}
+		je.Error(w, resp, http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		resp := &je.Response{
+			Code:    "not-found",
+			Message: fmt.Sprintf("index job %s not found", id),
+		}
+		je.Error(w, resp, http.StatusNotFound)
+		return
+	}
+	if job.State == JobQueued || job.State == JobRunning {
+		job.Progress = h.serv.State()
+	}
+
+	out := h.enc(w, r)
+	defer out.Close()
+	if err := json.NewEncoder(out).Encode(job); err != nil {
+		resp := &je.Response{
+			Code:    "encoding-error",
+			Message: fmt.Sprintf("failed to encode job: %v", err),
+		}
+		je.Error(w, resp, http.StatusInternalServerError)
+		return
+	}
+}
+
+// dispatchJobs runs async index jobs off h.jobQueue until it's closed. It's
+// started as DefaultAsyncWorkers (or WithAsyncWorkers) independent background
+// goroutines by NewHTTPTransport when WithAsyncIndex is used, so one wedged
+// or slow job doesn't stall the rest of the backlog.
+func (h *HTTP) dispatchJobs() {
+	for ij := range h.jobQueue {
+		h.runJob(ij)
+	}
+}
+
+// runJob indexes a single queued manifest and records the outcome. A panic
+// anywhere in here (most plausibly from Service.Index) is recovered and
+// recorded as a failed job rather than killing the calling dispatchJobs
+// goroutine -- without this, a single bad manifest would permanently take a
+// dispatcher worker out of rotation for the rest of the process's life.
+//
+// Service.Index is bounded by h.asyncJobTimeout (or DefaultAsyncJobTimeout):
+// without a deadline, a single Index call that hangs rather than panics
+// would park a dispatcher worker forever, and enough hung jobs eventually
+// exhaust every worker and fill the queue, taking the whole async path down.
+// The deadline reaches Index only through ctx, so an Index call that ignores
+// ctx still holds its worker until it returns.
+func (h *HTTP) runJob(ij *indexJob) {
+	timeout := h.asyncJobTimeout
+	if timeout <= 0 {
+		timeout = DefaultAsyncJobTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	defer func() {
+		if rec := recover(); rec != nil {
+			h.jobStore.Update(ctx, ij.job.ID, func(j *Job) {
+				j.State = JobFailed
+				j.Error = fmt.Sprintf("panic: %v", rec)
+			})
+		}
+	}()
+
+	queueTime := time.Since(ij.job.CreatedAt)
+	if h.metrics != nil {
+		h.metrics.JobDuration.WithLabelValues("queue").Observe(queueTime.Seconds())
+	}
+
+	h.jobStore.Update(ctx, ij.job.ID, func(j *Job) { j.State = JobRunning })
+
+	start := time.Now()
+	report, err := h.serv.Index(ctx, ij.manifest)
+	if h.metrics != nil {
+		h.metrics.JobDuration.WithLabelValues("index").Observe(time.Since(start).Seconds())
+	}
+	h.jobStore.Update(ctx, ij.job.ID, func(j *Job) {
+		if err != nil {
+			j.State = JobFailed
+			j.Error = err.Error()
+		} else {
+			j.State = JobSucceeded
+			j.Report = report
+		}
+	})
+
+	if ij.callbackURL != "" {
+		go sendCallback(ij.callbackURL, ij.manifest.Hash.String(), report, err)
+	}
+}
+
+// validateCallbackURL rejects callback URLs that could be used to make this
+// server issue SSRF requests against internal services or cloud metadata
+// endpoints (e.g. 169.254.169.254) on behalf of an untrusted caller: only
+// http/https are allowed, and every IP the host resolves to must be a
+// routable, non-private address.
+func validateCallbackURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("scheme %q is not allowed", u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return fmt.Errorf("failed to resolve host: %w", err)
+		}
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+			return fmt.Errorf("host resolves to disallowed address %s", ip)
+		}
+	}
+	return nil
+}
+
+var callbackClient = &http.Client{Timeout: 30 * time.Second}
+
+// sendCallback POSTs the final BatchReport for a completed async job to url,
+// retrying with exponential backoff on any non-2xx response or transport
+// error.
+func sendCallback(url, manifestHash string, report *claircore.IndexReport, jobErr error) {
+	payload := &BatchReport{ManifestHash: manifestHash, Report: report}
+	if jobErr != nil {
+		payload.Error = jobErr.Error()
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 0; attempt < 5; attempt++ {
+		resp, err := callbackClient.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return
+			}
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
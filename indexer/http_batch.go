@@ -0,0 +1,184 @@
+package indexer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/quay/claircore"
+	je "github.com/quay/claircore/pkg/jsonerr"
+)
+
+const (
+	IndexBatchAPIPath = "/api/v1/index_batch"
+
+	// DefaultBatchWorkers is the number of manifests indexed concurrently by
+	// IndexBatchHandler when the caller hasn't configured a different value.
+	DefaultBatchWorkers = 4
+)
+
+// BatchReport is the per-manifest record streamed back by IndexBatchHandler.
+//
+// Exactly one of Report or Error is populated.
+type BatchReport struct {
+	ManifestHash string                 `json:"manifest_hash"`
+	Report       *claircore.IndexReport `json:"report,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// IndexBatchHandler accepts either a JSON array of claircore.Manifest or a
+// newline-delimited JSON stream of the same, indexes them concurrently
+// (bounded by h.batchWorkers), and streams back a BatchReport per manifest as
+// NDJSON as soon as it's available.
+//
+// Unlike IndexHandler, a failure to index one manifest does not abort the
+// request: the error is reported inline and the batch continues.
+func (h *HTTP) IndexBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		resp := &je.Response{
+			Code:    "method-not-allowed",
+			Message: "endpoint only allows POST",
+		}
+		je.Error(w, resp, http.StatusMethodNotAllowed)
+		return
+	}
+
+	manifests, err := decodeManifests(r)
+	if err != nil {
+		resp := &je.Response{
+			Code:    "bad-request",
+			Message: fmt.Sprintf("failed to deserialize manifests: %v", err),
+		}
+		je.Error(w, resp, http.StatusBadRequest)
+		return
+	}
+
+	workers := h.batchWorkers
+	if workers < 1 {
+		workers = DefaultBatchWorkers
+	}
+
+	out := h.enc(w, r)
+	defer out.Close()
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	results := make(chan *BatchReport)
+	go dispatchIndexBatch(r.Context(), h.serv, manifests, workers, results)
+
+	jenc := json.NewEncoder(out)
+	for res := range results {
+		if err := jenc.Encode(res); err != nil {
+			// The client is gone or the connection is broken; nothing left
+			// to report to.
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// decodeManifests reads the request body as either a JSON array of
+// claircore.Manifest or an NDJSON stream of the same, distinguishing the two
+// by peeking at the first non-whitespace byte.
+func decodeManifests(r *http.Request) ([]*claircore.Manifest, error) {
+	br := bufio.NewReader(r.Body)
+	var b byte
+	var err error
+	for {
+		b, err = br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			break
+		}
+	}
+	if err := br.UnreadByte(); err != nil {
+		return nil, err
+	}
+
+	var ms []*claircore.Manifest
+	if b == '[' {
+		if err := json.NewDecoder(br).Decode(&ms); err != nil {
+			return nil, err
+		}
+		return ms, nil
+	}
+	dec := json.NewDecoder(br)
+	for dec.More() {
+		var m claircore.Manifest
+		if err := dec.Decode(&m); err != nil {
+			return nil, err
+		}
+		ms = append(ms, &m)
+	}
+	return ms, nil
+}
+
+// dispatchIndexBatch runs Service.Index over manifests using a bounded pool
+// of workers, sending a BatchReport to results for each manifest as it
+// completes, and closes results once all manifests are accounted for.
+//
+// This fans out by hand to the existing Service.Index rather than through a
+// Service.IndexBatch method: adding a method to Service is a breaking change
+// for every other implementation of that interface, which is out of scope
+// for an HTTP-layer change. If a real batch-aware Service method lands later,
+// this should be rewritten to call it directly.
+//
+// ctx is the request context: both the worker's send to results and this
+// function's send to work select on ctx.Done(), so that once the caller
+// stops reading results (e.g. the client disconnected and IndexBatchHandler
+// returned, which cancels the request context), every worker and this
+// goroutine unwind instead of blocking forever on a channel nobody reads
+// anymore.
+func dispatchIndexBatch(ctx context.Context, serv Service, manifests []*claircore.Manifest, workers int, results chan<- *BatchReport) {
+	defer close(results)
+
+	work := make(chan *claircore.Manifest)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				var m *claircore.Manifest
+				select {
+				case wm, ok := <-work:
+					if !ok {
+						return
+					}
+					m = wm
+				case <-ctx.Done():
+					return
+				}
+				res := &BatchReport{ManifestHash: m.Hash.String()}
+				report, err := serv.Index(ctx, m)
+				if err != nil {
+					res.Error = err.Error()
+				} else {
+					res.Report = report
+				}
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+send:
+	for _, m := range manifests {
+		select {
+		case work <- m:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(work)
+	wg.Wait()
+}
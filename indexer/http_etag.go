@@ -0,0 +1,102 @@
+package indexer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// reportETag derives a strong ETag for a manifest's index report from its
+// hash and the indexer's current state string. A report is invalidated
+// whenever the state changes, so the pair is exactly what distinguishes one
+// version of a report from the next.
+func reportETag(manifestHash, state string) string {
+	sum := sha256.Sum256([]byte(manifestHash + "|" + state))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+const (
+	// etagCacheTTL bounds how long reportModTime remembers a tag's
+	// first-observed time before sweepETagCache reclaims it. A manifest whose
+	// report is polled less often than this will see its Last-Modified reset
+	// to the next poll's time, which is a worse proxy but bounded memory beats
+	// an entry per (manifestHash, state) pair kept forever.
+	etagCacheTTL = time.Hour
+	// etagSweepInterval is how often runETagSweeper scans for expired tags.
+	etagSweepInterval = 10 * time.Minute
+)
+
+// etagEntry is the value stored in h.etagTimes: the tag's first-observed
+// time, plus when that entry was last read so the sweeper can tell whether
+// it's still in active use.
+type etagEntry struct {
+	modTime    time.Time
+	lastAccess time.Time
+}
+
+// reportModTime returns the time tag was first observed by this transport,
+// caching it so repeated polls of an unchanged report get a stable
+// Last-Modified. IndexReport itself carries no completion timestamp, so this
+// is the closest available proxy: it's correct as long as the first poll
+// for a given state happens at or after that state's completion.
+//
+// Entries older than etagCacheTTL since their last access are reclaimed by
+// runETagSweeper, so a long-running indexer's etagTimes map stays bounded by
+// recently-polled reports rather than growing by one entry per
+// (manifestHash, state) pair ever seen.
+func (h *HTTP) reportModTime(tag string) time.Time {
+	now := time.Now()
+	if v, ok := h.etagTimes.Load(tag); ok {
+		e := v.(etagEntry)
+		h.etagTimes.Store(tag, etagEntry{modTime: e.modTime, lastAccess: now})
+		return e.modTime
+	}
+	actual, loaded := h.etagTimes.LoadOrStore(tag, etagEntry{modTime: now, lastAccess: now})
+	e := actual.(etagEntry)
+	if loaded {
+		h.etagTimes.Store(tag, etagEntry{modTime: e.modTime, lastAccess: now})
+	}
+	return e.modTime
+}
+
+// runETagSweeper periodically reclaims etagTimes entries that haven't been
+// read in over etagCacheTTL. NewHTTPTransport starts this as a background
+// goroutine for the life of the process, the same way it starts dispatchJobs
+// for async indexing.
+func (h *HTTP) runETagSweeper() {
+	t := time.NewTicker(etagSweepInterval)
+	defer t.Stop()
+	for range t.C {
+		h.sweepETagCache(etagCacheTTL)
+	}
+}
+
+// sweepETagCache deletes every etagTimes entry last accessed before
+// ttl ago.
+func (h *HTTP) sweepETagCache(ttl time.Duration) {
+	cutoff := time.Now().Add(-ttl)
+	h.etagTimes.Range(func(k, v interface{}) bool {
+		if e := v.(etagEntry); e.lastAccess.Before(cutoff) {
+			h.etagTimes.Delete(k)
+		}
+		return true
+	})
+}
+
+// notModified reports whether r's conditional headers indicate the client
+// already has the version of the report identified by tag and modTime.
+// If-None-Match takes precedence over If-Modified-Since, per RFC 7232.
+func notModified(r *http.Request, tag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return inm == tag
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err == nil && !modTime.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	je "github.com/quay/claircore/pkg/jsonerr"
+)
+
+// writeWithDeadline encodes v through enc(), buffered against h.writeTimeout
+// and h.timeoutSoftLimit, and writes the result (or a timeout error in its
+// place) to w. See timeoutWriter.
+//
+// start is when the request actually began -- normally captured at the top
+// of the calling handler, before any work like Service.Index ran -- since
+// http.Server.WriteTimeout starts ticking from there, not from when encoding
+// happens to begin. Anchoring the deadline to start (rather than to "now",
+// here) ensures a slow Index/IndexReport call eats into the same budget the
+// real server deadline is counting down, instead of this handler getting a
+// fresh full writeTimeout window regardless of how long that call took.
+func (h *HTTP) writeWithDeadline(w http.ResponseWriter, r *http.Request, status int, v interface{}, start time.Time) {
+	tw := newTimeoutWriter(w, start, h.writeTimeout, h.timeoutSoftLimit)
+	out := h.enc(tw.rec, r)
+	err := json.NewEncoder(out).Encode(v)
+	// A compressor may only hit the soft limit while flushing on Close.
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil && !errors.Is(err, errSoftLimitExceeded) {
+		resp := &je.Response{
+			Code:    "encoding-error",
+			Message: "failed to encode scan report: " + err.Error(),
+		}
+		je.Error(w, resp, http.StatusInternalServerError)
+		return
+	}
+	tw.finish(status, err)
+}
+
+// DefaultTimeoutSoftLimit is the buffered-body size above which
+// timeoutWriter gives up on the in-flight encoding rather than risk racing
+// the server's write deadline.
+const DefaultTimeoutSoftLimit = 1 << 20 // 1MiB
+
+// errSoftLimitExceeded is returned by bufResponseWriter.Write once the
+// buffered body grows past its soft limit, aborting the in-progress encode.
+var errSoftLimitExceeded = errors.New("indexer: buffered response exceeded soft limit")
+
+// bufResponseWriter is a minimal http.ResponseWriter that collects headers
+// and body written by enc() in memory instead of putting them on the wire,
+// so timeoutWriter can decide after the fact whether the result is still
+// safe to send.
+type bufResponseWriter struct {
+	header    http.Header
+	buf       bytes.Buffer
+	softLimit int
+}
+
+func newBufResponseWriter(softLimit int) *bufResponseWriter {
+	if softLimit <= 0 {
+		softLimit = DefaultTimeoutSoftLimit
+	}
+	return &bufResponseWriter{
+		header:    make(http.Header),
+		softLimit: softLimit,
+	}
+}
+
+func (b *bufResponseWriter) Header() http.Header { return b.header }
+
+func (b *bufResponseWriter) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.softLimit {
+		return 0, errSoftLimitExceeded
+	}
+	return b.buf.Write(p)
+}
+
+// WriteHeader is a no-op: the eventual status is decided by timeoutWriter
+// once the body is fully buffered.
+func (b *bufResponseWriter) WriteHeader(int) {}
+
+// timeoutWriter buffers an encoded response body written through enc() and,
+// once encoding completes, decides whether there's still enough time before
+// the server's WriteTimeout to deliver it as encoded. If the deadline was
+// raced (or the body outgrew its soft limit), it discards the buffer and
+// sends an identity-encoded je.Response timeout error instead of risking a
+// client receiving a truncated, unterminated compressed stream.
+//
+// Both paths set an explicit Content-Length and write the full body in one
+// call, so chunked transfer is never used here.
+type timeoutWriter struct {
+	w        http.ResponseWriter
+	rec      *bufResponseWriter
+	deadline time.Time
+}
+
+// newTimeoutWriter returns a timeoutWriter ready to have enc(tw.rec, r) run
+// against it. writeTimeout is normally http.Server.WriteTimeout; zero
+// disables deadline tracking (the buffered body is always sent as encoded,
+// subject only to softLimit). The deadline is anchored to start -- when the
+// request actually began, not when this is called -- so it reflects however
+// much of writeTimeout earlier work in the handler already spent.
+func newTimeoutWriter(w http.ResponseWriter, start time.Time, writeTimeout time.Duration, softLimit int) *timeoutWriter {
+	tw := &timeoutWriter{
+		w:   w,
+		rec: newBufResponseWriter(softLimit),
+	}
+	if writeTimeout > 0 {
+		tw.deadline = start.Add(writeTimeout)
+	}
+	return tw
+}
+
+// raced reports whether the buffered body missed the write deadline, or
+// never finished because it outgrew its soft limit.
+func (tw *timeoutWriter) raced(encodeErr error) bool {
+	if errors.Is(encodeErr, errSoftLimitExceeded) {
+		return true
+	}
+	return !tw.deadline.IsZero() && time.Now().After(tw.deadline)
+}
+
+// finish delivers the buffered body with status as its status code, or, if
+// the deadline was raced, an identity-encoded timeout error instead.
+// encodeErr is the error (if any) returned while encoding into tw.rec; any
+// error other than errSoftLimitExceeded should be handled by the caller
+// before finish is ever called.
+func (tw *timeoutWriter) finish(status int, encodeErr error) {
+	if !tw.raced(encodeErr) {
+		h := tw.w.Header()
+		for k, v := range tw.rec.header {
+			h[k] = v
+		}
+		h.Set("content-length", strconv.Itoa(tw.rec.buf.Len()))
+		tw.w.WriteHeader(status)
+		tw.w.Write(tw.rec.buf.Bytes())
+		return
+	}
+
+	resp := &je.Response{
+		Code:    "timeout",
+		Message: "index report did not finish encoding before the server's write timeout",
+	}
+	b, _ := json.Marshal(resp)
+	h := tw.w.Header()
+	h.Set("content-encoding", "identity")
+	h.Set("content-type", "application/json")
+	h.Set("content-length", strconv.Itoa(len(b)))
+	tw.w.WriteHeader(http.StatusGatewayTimeout)
+	tw.w.Write(b)
+}
@@ -9,11 +9,16 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/klauspost/compress/flate"
 	"github.com/klauspost/compress/gzip"
 	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
 	"github.com/markusthoemmes/goautoneg"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/quay/claircore"
 	je "github.com/quay/claircore/pkg/jsonerr"
@@ -30,6 +35,152 @@ const (
 type HTTP struct {
 	*http.ServeMux
 	serv Service
+
+	// batchWorkers bounds the number of manifests IndexBatchHandler indexes
+	// concurrently. Zero means DefaultBatchWorkers.
+	batchWorkers int
+
+	// writeTimeout, when nonzero, should match the http.Server's
+	// WriteTimeout. It's used by IndexHandler and IndexReportHandler to
+	// avoid streaming a compressed body that the deadline would cut off
+	// mid-write. Zero disables the protection.
+	writeTimeout time.Duration
+	// timeoutSoftLimit bounds the buffered body size used to enforce
+	// writeTimeout. See WithWriteTimeout.
+	timeoutSoftLimit int
+
+	// disabledEncodings lists content-codings enc should never pick, even
+	// if a client accepts them. See WithDisabledEncodings.
+	disabledEncodings map[string]bool
+
+	// metricsReg, if non-nil, is the registry instrumented handlers report
+	// to and (if metricsPath is set) that backs the /metrics endpoint. See
+	// WithMetrics.
+	metricsReg  *prometheus.Registry
+	metricsPath string
+	// metrics is the set of collectors Register returned for metricsReg. It's
+	// nil unless WithMetrics is used, and is only ever touched by this HTTP
+	// instance. A second instance given the same metricsReg fails in
+	// NewHTTPTransport, since Register cannot add the same collectors twice.
+	metrics *Metrics
+
+	// jobStore and jobQueue back async index submission. jobStore is nil
+	// unless WithAsyncIndex is used. See indexAsync and dispatchJobs.
+	jobStore JobStore
+	jobQueue chan *indexJob
+	// asyncQueueSize and asyncWorkers size h.jobQueue and the number of
+	// dispatchJobs goroutines NewHTTPTransport starts. Zero means
+	// DefaultAsyncQueueSize / DefaultAsyncWorkers. See WithAsyncQueueSize and
+	// WithAsyncWorkers.
+	asyncQueueSize int
+	asyncWorkers   int
+	// allowCallbacks gates whether indexAsync accepts a caller-supplied
+	// callback_url at all. It defaults to off: POSTing job results to an
+	// arbitrary caller-supplied URL is an SSRF vector, so it must be enabled
+	// explicitly via WithAsyncCallbacks. Even when enabled, every submitted
+	// callback_url is still validated by validateCallbackURL.
+	allowCallbacks bool
+	// asyncJobTimeout bounds a single runJob's Service.Index call. Zero means
+	// DefaultAsyncJobTimeout. See WithAsyncJobTimeout.
+	asyncJobTimeout time.Duration
+
+	// etagTimes caches the first-observed time of each index report ETag,
+	// used as its Last-Modified. See reportModTime.
+	etagTimes sync.Map
+}
+
+// Option configures an HTTP transport. See NewHTTPTransport.
+type Option func(*HTTP)
+
+// WithBatchWorkers sets the size of the worker pool IndexBatchHandler uses
+// to index manifests concurrently. The default is DefaultBatchWorkers.
+func WithBatchWorkers(n int) Option {
+	return func(h *HTTP) { h.batchWorkers = n }
+}
+
+// WithWriteTimeout arranges for IndexHandler and IndexReportHandler to
+// buffer their encoded response (up to softLimit bytes, or
+// DefaultTimeoutSoftLimit if softLimit is zero) and fall back to an
+// identity-encoded timeout error rather than stream a response the given
+// write timeout would truncate mid-flight. writeTimeout should normally
+// match the http.Server's WriteTimeout.
+func WithWriteTimeout(writeTimeout time.Duration, softLimit int) Option {
+	return func(h *HTTP) {
+		h.writeTimeout = writeTimeout
+		h.timeoutSoftLimit = softLimit
+	}
+}
+
+// WithDisabledEncodings prevents enc from ever selecting the named
+// content-codings (e.g. "zstd", "br"), regardless of what a client's
+// accept-encoding header prefers. Names match the values used in the
+// content-encoding header: "gzip", "deflate", "snappy", "zstd", "br".
+func WithDisabledEncodings(names ...string) Option {
+	return func(h *HTTP) {
+		if h.disabledEncodings == nil {
+			h.disabledEncodings = make(map[string]bool, len(names))
+		}
+		for _, n := range names {
+			h.disabledEncodings[n] = true
+		}
+	}
+}
+
+// WithMetrics instruments every registered handler with Prometheus request
+// count, duration, in-flight, and response size collectors, registered
+// against reg (see Register). If path is non-empty, reg is also served there
+// on the same ServeMux via promhttp; with an empty path nothing is mounted,
+// and embedders that would rather serve reg themselves (or on a different
+// mux) read its collectors out-of-band instead.
+func WithMetrics(reg *prometheus.Registry, path string) Option {
+	return func(h *HTTP) {
+		h.metricsReg = reg
+		h.metricsPath = path
+	}
+}
+
+// WithAsyncIndex enables POST /api/v1/index?async=1 and IndexJobHandler. It
+// installs store as the JobStore tracking job state, or an in-process map if
+// store is nil, and arranges for NewHTTPTransport to size h.jobQueue and
+// start the background dispatcher goroutines that run queued jobs.
+func WithAsyncIndex(store JobStore) Option {
+	return func(h *HTTP) {
+		if store == nil {
+			store = newMemJobStore()
+		}
+		h.jobStore = store
+	}
+}
+
+// WithAsyncQueueSize overrides DefaultAsyncQueueSize: how many submitted-but-
+// not-yet-running jobs h.jobQueue buffers before indexAsync starts rejecting
+// new submissions with 503. Only meaningful alongside WithAsyncIndex.
+func WithAsyncQueueSize(n int) Option {
+	return func(h *HTTP) { h.asyncQueueSize = n }
+}
+
+// WithAsyncWorkers overrides DefaultAsyncWorkers: how many dispatchJobs
+// goroutines run concurrently. Only meaningful alongside WithAsyncIndex.
+func WithAsyncWorkers(n int) Option {
+	return func(h *HTTP) { h.asyncWorkers = n }
+}
+
+// WithAsyncCallbacks enables the optional callback_url field on async index
+// submissions: once a job completes, this server will POST its result to
+// that caller-supplied URL. It's off by default because it otherwise lets
+// any caller of POST /api/v1/index?async=1 make this server issue arbitrary
+// outbound requests (SSRF); every callback_url is still validated by
+// validateCallbackURL even when enabled. Only meaningful alongside
+// WithAsyncIndex.
+func WithAsyncCallbacks() Option {
+	return func(h *HTTP) { h.allowCallbacks = true }
+}
+
+// WithAsyncJobTimeout overrides DefaultAsyncJobTimeout: how long runJob waits
+// on a single Service.Index call before abandoning it as failed. Only
+// meaningful alongside WithAsyncIndex.
+func WithAsyncJobTimeout(d time.Duration) Option {
+	return func(h *HTTP) { h.asyncJobTimeout = d }
 }
 
 var (
@@ -50,18 +201,60 @@ var (
 			return w
 		},
 	}
+	zstdPool = sync.Pool{
+		New: func() interface{} {
+			w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+			return w
+		},
+	}
+	brotliPool = sync.Pool{
+		New: func() interface{} {
+			return brotli.NewWriterLevel(nil, brotli.DefaultCompression)
+		},
+	}
 )
 
-// Enc picks a suitable content encoding, sets the correct header, and returns
-// an io.WriteCloser configured to write the chosen format to the
+// Enc picks the highest-quality content encoding the client accepts and this
+// transport hasn't disabled, sets the correct header, and returns an
+// io.WriteCloser configured to write the chosen format to the
 // http.ResponseWriter.
 //
 // The caller must call Close to ensure all data is flushed.
-func enc(w http.ResponseWriter, r *http.Request) io.WriteCloser {
+//
+// If r's context carries an uncompressedBytesKey counter (installed by
+// instrument), the returned WriteCloser also tallies bytes written into it,
+// so instrument can report response size both before and after compression.
+func (h *HTTP) enc(w http.ResponseWriter, r *http.Request) (wc io.WriteCloser) {
+	if n, ok := r.Context().Value(uncompressedBytesKey{}).(*int64); ok {
+		defer func() {
+			wc = &countingWriteCloser{WriteCloser: wc, n: n}
+		}()
+	}
 	as := goautoneg.ParseAccept(r.Header.Get("accept-encoding"))
+	sort.SliceStable(as, func(i, j int) bool { return as[i].Q > as[j].Q })
 Pick:
 	for _, a := range as {
+		// q=0 marks a coding the client refuses.
+		if a.Q <= 0 || h.disabledEncodings[a.Type] {
+			continue
+		}
 		switch a.Type {
+		case "zstd":
+			w.Header().Set("content-encoding", "zstd")
+			wc := zstdPool.Get().(*zstd.Encoder)
+			wc.Reset(w)
+			return &poolCloser{
+				pool:        &zstdPool,
+				WriteCloser: wc,
+			}
+		case "br":
+			w.Header().Set("content-encoding", "br")
+			wc := brotliPool.Get().(*brotli.Writer)
+			wc.Reset(w)
+			return &poolCloser{
+				pool:        &brotliPool,
+				WriteCloser: wc,
+			}
 		case "gzip":
 			w.Header().Set("content-encoding", "gzip")
 			wc := gzipPool.Get().(*gzip.Writer)
@@ -117,10 +310,35 @@ func (p *poolCloser) Close() error {
 	return nil
 }
 
-func NewHTTPTransport(service Service) (*HTTP, error) {
+func NewHTTPTransport(service Service, opt ...Option) (*HTTP, error) {
 	h := &HTTP{
 		serv: service,
 	}
+	for _, o := range opt {
+		o(h)
+	}
+	if h.metricsReg != nil {
+		m, err := Register(h.metricsReg)
+		if err != nil {
+			return nil, err
+		}
+		h.metrics = m
+	}
+	if h.jobStore != nil {
+		queueSize := h.asyncQueueSize
+		if queueSize < 1 {
+			queueSize = DefaultAsyncQueueSize
+		}
+		workers := h.asyncWorkers
+		if workers < 1 {
+			workers = DefaultAsyncWorkers
+		}
+		h.jobQueue = make(chan *indexJob, queueSize)
+		for i := 0; i < workers; i++ {
+			go h.dispatchJobs()
+		}
+	}
+	go h.runETagSweeper()
 	mux := http.NewServeMux()
 	h.Register(mux)
 	h.ServeMux = mux
@@ -128,10 +346,11 @@ func NewHTTPTransport(service Service) (*HTTP, error) {
 }
 
 func (h *HTTP) IndexReportHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	start := time.Now()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		resp := &je.Response{
 			Code:    "method-not-allowed",
-			Message: "endpoint only allows GET",
+			Message: "endpoint only allows GET and HEAD",
 		}
 		je.Error(w, resp, http.StatusMethodNotAllowed)
 		return
@@ -165,7 +384,24 @@ func (h *HTTP) IndexReportHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	out := enc(w, r)
+	tag := reportETag(manifestHash, h.serv.State())
+	modTime := h.reportModTime(tag)
+	w.Header().Set("etag", tag)
+	w.Header().Set("last-modified", modTime.UTC().Format(http.TimeFormat))
+	if notModified(r, tag, modTime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if h.writeTimeout > 0 {
+		h.writeWithDeadline(w, r, http.StatusOK, report, start)
+		return
+	}
+	out := h.enc(w, r)
 	defer out.Close()
 	err = json.NewEncoder(out).Encode(report)
 	if err != nil {
@@ -179,6 +415,7 @@ func (h *HTTP) IndexReportHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *HTTP) IndexHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	if r.Method != http.MethodPost {
 		resp := &je.Response{
 			Code:    "method-not-allowed",
@@ -188,6 +425,19 @@ func (h *HTTP) IndexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Query().Get("async") == "1" {
+		if h.jobStore == nil {
+			resp := &je.Response{
+				Code:    "not-implemented",
+				Message: "async indexing is not enabled on this server",
+			}
+			je.Error(w, resp, http.StatusNotImplemented)
+			return
+		}
+		h.indexAsync(w, r)
+		return
+	}
+
 	var m claircore.Manifest
 	err := json.NewDecoder(r.Body).Decode(&m)
 	if err != nil {
@@ -210,7 +460,11 @@ func (h *HTTP) IndexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	out := enc(w, r)
+	if h.writeTimeout > 0 {
+		h.writeWithDeadline(w, r, http.StatusCreated, report, start)
+		return
+	}
+	out := h.enc(w, r)
 	defer out.Close()
 	w.WriteHeader(http.StatusCreated)
 	err = json.NewEncoder(out).Encode(report)
@@ -248,7 +502,23 @@ func (h *HTTP) StateHandler(w http.ResponseWriter, r *http.Request) {
 
 // Register will register the api on a given mux.
 func (h *HTTP) Register(mux *http.ServeMux) {
-	mux.HandleFunc(IndexAPIPath, h.IndexHandler)
-	mux.HandleFunc(IndexReportAPIPath, h.IndexReportHandler)
-	mux.HandleFunc(StateAPIPath, h.StateHandler)
+	handlers := map[string]http.HandlerFunc{
+		IndexAPIPath:       h.IndexHandler,
+		IndexBatchAPIPath:  h.IndexBatchHandler,
+		IndexReportAPIPath: h.IndexReportHandler,
+		StateAPIPath:       h.StateHandler,
+	}
+	if h.jobStore != nil {
+		handlers[IndexJobAPIPath] = h.IndexJobHandler
+	}
+	for path, handler := range handlers {
+		if h.metricsReg != nil {
+			handler = h.instrument(path, handler)
+		}
+		mux.HandleFunc(path, handler)
+	}
+
+	if h.metricsReg != nil && h.metricsPath != "" {
+		mux.Handle(h.metricsPath, promhttp.HandlerFor(h.metricsReg, promhttp.HandlerOpts{}))
+	}
 }
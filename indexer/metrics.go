@@ -0,0 +1,181 @@
+package indexer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "claircore"
+	metricsSubsystem = "indexer"
+)
+
+// Metrics holds one HTTP transport's Prometheus collectors. Register (and so
+// WithMetrics) creates a fresh set per call. The collector names are fixed,
+// so a second set cannot be registered against the same *prometheus.Registry:
+// each instrumented HTTP instance needs its own registry.
+type Metrics struct {
+	RequestsTotal    *prometheus.CounterVec
+	RequestDuration  *prometheus.HistogramVec
+	RequestsInFlight *prometheus.GaugeVec
+	// ResponseBytesIn is the size of the JSON a handler encoded, before
+	// compression. ResponseBytesOut is what actually reached the wire.
+	ResponseBytesIn  *prometheus.HistogramVec
+	ResponseBytesOut *prometheus.HistogramVec
+	// JobDuration is how long an async index job (see WithAsyncIndex) spent
+	// in each stage: "queue" (time between submission and a dispatcher
+	// worker picking it up) and "index" (the Service.Index call itself).
+	JobDuration *prometheus.HistogramVec
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		RequestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "http_requests_total",
+			Help:      "Total number of HTTP requests handled, by handler and status code.",
+		}, []string{"handler", "code"}),
+		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time to fully serve an HTTP request, by handler. For synchronous IndexHandler requests this includes the Service.Index call itself.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"handler"}),
+		RequestsInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "http_requests_in_flight",
+			Help:      "Number of HTTP requests currently being served, by handler.",
+		}, []string{"handler"}),
+		ResponseBytesIn: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "http_response_bytes_in",
+			Help:      "Size of the JSON a handler encoded, before compression, by handler.",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+		}, []string{"handler"}),
+		ResponseBytesOut: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "http_response_bytes_out",
+			Help:      "Size of the bytes written to the wire per response, after compression, by handler and content-encoding.",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+		}, []string{"handler", "encoding"}),
+		JobDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "index_job_duration_seconds",
+			Help:      "Time an async index job (see WithAsyncIndex) spent in each stage.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"stage"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.RequestsTotal,
+		m.RequestDuration,
+		m.RequestsInFlight,
+		m.ResponseBytesIn,
+		m.ResponseBytesOut,
+		m.JobDuration,
+	}
+}
+
+// Register creates a fresh Metrics set and registers its collectors against
+// reg. Embedders that maintain their own *prometheus.Registry can call this
+// directly; WithMetrics calls it for you, once per HTTP instance, so that
+// instance's counters are attached there instead of
+// prometheus.DefaultRegisterer. It returns prometheus's AlreadyRegisteredError
+// if reg already holds collectors of the same names, e.g. from an earlier
+// call.
+func Register(reg *prometheus.Registry) (*Metrics, error) {
+	m := newMetrics()
+	for _, c := range m.collectors() {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// statusRecorder wraps a http.ResponseWriter to capture the status code and
+// on-the-wire byte count of a response for instrument, while still passing
+// through http.Flusher so handlers like IndexBatchHandler keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// uncompressedBytesKey is the context key h.enc uses to find the counter
+// instrument installed, so it can tally the bytes a handler encoded before
+// they reach a compressor.
+type uncompressedBytesKey struct{}
+
+// countingWriteCloser tallies bytes written to it into n, in addition to
+// passing them through to the wrapped io.WriteCloser.
+type countingWriteCloser struct {
+	io.WriteCloser
+	n *int64
+}
+
+func (c *countingWriteCloser) Write(p []byte) (int, error) {
+	n, err := c.WriteCloser.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// instrument wraps next so every request records its status, duration,
+// pre/post-compression response size, and in-flight count under the given
+// handler label, against h.metrics.
+func (h *HTTP) instrument(handler string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.metrics.RequestsInFlight.WithLabelValues(handler).Inc()
+		defer h.metrics.RequestsInFlight.WithLabelValues(handler).Dec()
+
+		var uncompressed int64
+		r = r.WithContext(context.WithValue(r.Context(), uncompressedBytesKey{}, &uncompressed))
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next(rec, r)
+		dur := time.Since(start)
+
+		h.metrics.RequestDuration.WithLabelValues(handler).Observe(dur.Seconds())
+		h.metrics.RequestsTotal.WithLabelValues(handler, strconv.Itoa(rec.status)).Inc()
+		encoding := rec.Header().Get("content-encoding")
+		if encoding == "" {
+			encoding = "identity"
+		}
+		h.metrics.ResponseBytesOut.WithLabelValues(handler, encoding).Observe(float64(rec.bytes))
+		if n := atomic.LoadInt64(&uncompressed); n > 0 {
+			h.metrics.ResponseBytesIn.WithLabelValues(handler).Observe(float64(n))
+		}
+	}
+}
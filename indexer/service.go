@@ -0,0 +1,22 @@
+package indexer
+
+import (
+	"context"
+
+	"github.com/quay/claircore"
+)
+
+// Service is the indexing backend an HTTP transport delegates to. It's
+// satisfied by claircore's own libindex.Libindex; this package only depends
+// on the three methods actually used by the handlers in this package.
+type Service interface {
+	// Index runs the indexer against manifest and returns the resulting
+	// report.
+	Index(ctx context.Context, manifest *claircore.Manifest) (*claircore.IndexReport, error)
+	// IndexReport returns the stored report for manifestHash, or
+	// ok == false if none exists.
+	IndexReport(ctx context.Context, manifestHash string) (report *claircore.IndexReport, ok bool, err error)
+	// State returns an opaque string that changes whenever a change to the
+	// indexer's configuration would invalidate previously computed reports.
+	State() string
+}